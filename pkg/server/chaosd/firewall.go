@@ -0,0 +1,313 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaosd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	pb "github.com/chaos-mesh/chaos-daemon/pkg/server/serverpb"
+)
+
+// FirewallBackend is how chaosd applies per-container network chaos rules,
+// abstracting over whichever firewall subsystem actually owns packet filtering on
+// the host: iptables, nftables, or firewalld. Every rule string passed to
+// EnsureRule uses iptables syntax (e.g. "-A CHAOS-INPUT -m set --match-set ... -j
+// DROP"); backends that are not themselves iptables translate it into their own
+// representation.
+type FirewallBackend interface {
+	// EnsureChain creates chainName if it does not already exist.
+	EnsureChain(chainName string) error
+	// EnsureRule appends rule to chainName if an equivalent rule is not already
+	// present.
+	EnsureRule(chainName, rule string) error
+	// FlushChain removes every rule from chainName without deleting the chain.
+	FlushChain(chainName string) error
+	// DeleteChain removes chainName entirely.
+	DeleteChain(chainName string) error
+	// Flush commits every change staged by the methods above to the host.
+	Flush() error
+}
+
+// firewallBackendKind identifies which FirewallBackend implementation to build.
+type firewallBackendKind string
+
+const (
+	firewallBackendIptables  firewallBackendKind = "iptables"
+	firewallBackendNftables  firewallBackendKind = "nftables"
+	firewallBackendFirewalld firewallBackendKind = "firewalld"
+)
+
+// FirewallBackendOverride forces DetectFirewallBackend to use a specific backend
+// instead of auto-detecting one. There is no CLI flag plumbed to it yet in this
+// tree, so it also reads the CHAOS_FIREWALL_BACKEND environment variable as an
+// interim way for operators to set it; once a real `--firewall-backend` flag
+// exists on the chaosd server it should set this var directly instead.
+var FirewallBackendOverride = os.Getenv("CHAOS_FIREWALL_BACKEND")
+
+// DetectFirewallBackend picks the firewall backend to drive on this host: it
+// honors FirewallBackendOverride if set, otherwise it probes for `nft` and falls
+// back to iptables, which every supported kernel/distro combination chaosd
+// targets has available.
+//
+// firewalld is deliberately not part of auto-detection: firewalldClient's direct
+// interface talks to the single system-wide firewalld instance and cannot be
+// scoped to nsPath's container, so picking it automatically would silently apply
+// chaos rules to the host's real INPUT/OUTPUT chains instead of the target
+// container's. It remains reachable via an explicit FirewallBackendOverride for
+// operators who understand and accept that scope.
+func DetectFirewallBackend(ctx context.Context, nsPath string) (FirewallBackend, error) {
+	switch firewallBackendKind(FirewallBackendOverride) {
+	case firewallBackendIptables:
+		return buildIptablesClient(ctx, nsPath, ipv4, filterTable), nil
+	case firewallBackendNftables:
+		return buildNftablesClient(ctx, nsPath), nil
+	case firewallBackendFirewalld:
+		return buildFirewalldClient(ctx, nsPath)
+	case "":
+		// fall through to auto-detection below
+	default:
+		return nil, errors.Errorf("unknown firewall backend override %q", FirewallBackendOverride)
+	}
+
+	if hasNft() {
+		return buildNftablesClient(ctx, nsPath), nil
+	}
+
+	return buildIptablesClient(ctx, nsPath, ipv4, filterTable), nil
+}
+
+// nftDetectOnce and nftDetected cache the result of probing for the `nft`
+// binary: DetectFirewallBackend runs once per chaos request, and re-probing
+// exec.LookPath on every single request is wasted work since the host's
+// available firewall tooling cannot change between requests.
+var (
+	nftDetectOnce sync.Once
+	nftDetected   bool
+)
+
+func hasNft() bool {
+	nftDetectOnce.Do(func() {
+		_, err := exec.LookPath(nftCmd)
+		nftDetected = err == nil
+	})
+	return nftDetected
+}
+
+// firewallChainsForTable returns the real built-in chains that need a chaos jump
+// chain in table: the filter table only ever sees traffic at INPUT/OUTPUT, the
+// nat table only has an opportunity to DNAT/SNAT at PREROUTING/POSTROUTING, and
+// the mangle table additionally hooks FORWARD since MARK-based routing chaos can
+// apply to traffic this host is only forwarding, not originating or receiving.
+func firewallChainsForTable(table string) []string {
+	switch table {
+	case natTable:
+		return []string{"PREROUTING", "POSTROUTING"}
+	case mangleTable:
+		return []string{"PREROUTING", "POSTROUTING", "FORWARD"}
+	default:
+		return []string{"INPUT", "OUTPUT"}
+	}
+}
+
+// chaosJumpChainNameFor returns the chaos-owned jump chain backend wires into
+// realChain at this IP version. iptablesClient names it itself, adding a "6"
+// suffix on the ip6tables side (see chaosChainName); nftables only
+// ever hooks the base INPUT/OUTPUT chains ensureTable creates, so it errors on
+// any other realChain, which the backend-selection in SetContainerIptablesChains
+// already keeps from happening for nat/mangle tables.
+func chaosJumpChainNameFor(backend FirewallBackend, version ipVersion, realChain string) (string, error) {
+	if ic, ok := backend.(*iptablesClient); ok {
+		return ic.chaosChainName(realChain), nil
+	}
+
+	switch realChain {
+	case "INPUT", "OUTPUT":
+		return "CHAOS-" + realChain, nil
+	default:
+		return "", errors.Errorf("firewall backend %T does not support the %s chain", backend, realChain)
+	}
+}
+
+// realChainFor returns the backend-specific spelling of realChain: nftablesClient
+// hooks lowercase "input"/"output" base chains instead of iptables' INPUT/OUTPUT.
+func realChainFor(backend FirewallBackend, realChain string) string {
+	if _, ok := backend.(*nftablesClient); ok {
+		return strings.ToLower(realChain)
+	}
+	return realChain
+}
+
+// initializeFirewallEnv makes sure backend's chaos jump chains exist and are
+// wired into the real chains table hands traffic through, once per (backend,
+// version, table) tuple.
+func initializeFirewallEnv(backend FirewallBackend, version ipVersion, table string) error {
+	for _, chain := range firewallChainsForTable(table) {
+		chaosChain, err := chaosJumpChainNameFor(backend, version, chain)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		realChain := realChainFor(backend, chain)
+
+		if err := backend.EnsureChain(chaosChain); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := backend.EnsureRule(realChain, "-A "+realChain+" -j "+chaosChain); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// realChainForDirection returns the built-in chain name chain.Direction hooks
+// into: PREROUTING/POSTROUTING/FORWARD exist alongside the original INPUT/OUTPUT
+// so nat and mangle chains can target the DNAT/SNAT/MARK-relevant stage of packet
+// handling.
+func realChainForDirection(direction pb.Chain_Direction) (string, error) {
+	switch direction {
+	case pb.Chain_INPUT:
+		return "INPUT", nil
+	case pb.Chain_OUTPUT:
+		return "OUTPUT", nil
+	case pb.Chain_PREROUTING:
+		return "PREROUTING", nil
+	case pb.Chain_POSTROUTING:
+		return "POSTROUTING", nil
+	case pb.Chain_FORWARD:
+		return "FORWARD", nil
+	default:
+		return "", fmt.Errorf("unknown chain direction %d", direction)
+	}
+}
+
+// chainDirectionAllowedForTable reports whether realChain is one of the
+// built-in chains firewallChainsForTable(table) wires a chaos jump chain into.
+// A Chain naming a mismatched pair (e.g. Direction=INPUT with Table=NAT) would
+// otherwise build and populate a real chain that initializeFirewallEnv never
+// links anything to, silently turning the experiment into a no-op.
+func chainDirectionAllowedForTable(realChain, table string) bool {
+	for _, allowed := range firewallChainsForTable(table) {
+		if realChain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ipsetMatchDirection reports whether chain's ipsets should be matched as the
+// packet's source or destination address. PREROUTING and FORWARD see traffic
+// before it's been attributed to this host, so they're matched the same way as
+// INPUT; POSTROUTING matches like OUTPUT since both see traffic this host (or,
+// for FORWARD traffic re-marked downstream, another host) is sending onward.
+func ipsetMatchDirection(direction pb.Chain_Direction) string {
+	if direction == pb.Chain_OUTPUT || direction == pb.Chain_POSTROUTING {
+		return "dst"
+	}
+	return "src"
+}
+
+// targetClause renders the extra arguments a DNAT, SNAT, or MARK target needs
+// beyond "-j <Target>". At most one of ToDestination/ToSource/MarkValue is set
+// on any given chain, matching the target it names.
+func targetClause(chain *pb.Chain) string {
+	switch {
+	case chain.ToDestination != "":
+		return " --to-destination " + chain.ToDestination
+	case chain.ToSource != "":
+		return " --to-source " + chain.ToSource
+	case chain.MarkValue != "":
+		return " --set-mark " + chain.MarkValue
+	default:
+		return ""
+	}
+}
+
+// applyFirewallChain builds the ipset-membership rules for chain and installs
+// them against backend, then wires chain.Name into the chaos jump chain for its
+// direction. It is backend-agnostic: the rule strings it builds are always
+// iptables syntax, and every FirewallBackend implementation knows how to
+// interpret (or translate) that syntax.
+func applyFirewallChain(backend FirewallBackend, chain *pb.Chain, version ipVersion) error {
+	realChain, err := realChainForDirection(chain.Direction)
+	if err != nil {
+		return err
+	}
+	table := tableName(chain.Table)
+	if !chainDirectionAllowedForTable(realChain, table) {
+		return errors.Errorf("chain %q: direction %s is not reachable in table %s", chain.Name, chain.Direction, table)
+	}
+	matchPart := ipsetMatchDirection(chain.Direction)
+	extra := targetClause(chain)
+
+	protocolAndPort := chain.Protocol
+	if len(protocolAndPort) > 0 {
+		if len(chain.SourcePorts) > 0 {
+			protocolAndPort += " " + chain.SourcePorts
+		}
+
+		if len(chain.DestinationPorts) > 0 {
+			protocolAndPort += " " + chain.DestinationPorts
+		}
+	}
+
+	if err := backend.EnsureChain(chain.Name); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := backend.FlushChain(chain.Name); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, ipset := range chain.Ipsets {
+		rule := fmt.Sprintf("-A %s -m set --match-set %s %s -j %s%s -w 5 %s",
+			chain.Name, ipset, matchPart, chain.Target, extra, protocolAndPort)
+		if err := backend.EnsureRule(chain.Name, rule); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	chaosChain, err := chaosJumpChainNameFor(backend, version, realChain)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := backend.EnsureRule(chaosChain, "-A "+chaosChain+" -j "+chain.Name); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// rollbackFirewallBackend undoes backend's most recent changes, for backends that
+// support it: what it has staged since its last Flush or, with nothing staged,
+// what that last Flush committed (see iptablesClient.Rollback). Only the
+// iptables/ip6tables backend keeps that history; other backends apply each change
+// immediately and keep none, so for them this does nothing.
+func rollbackFirewallBackend(backend FirewallBackend) {
+	ic, ok := backend.(*iptablesClient)
+	if !ok {
+		return
+	}
+
+	if err := ic.Rollback(); err != nil {
+		log.Error("failed to roll back firewall backend", zap.Error(err))
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaosd
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/chaos-mesh/chaos-daemon/pkg/server/serverpb"
+)
+
+func TestDetectFirewallBackendOverride(t *testing.T) {
+	prior := FirewallBackendOverride
+	defer func() { FirewallBackendOverride = prior }()
+
+	FirewallBackendOverride = string(firewallBackendIptables)
+	backend, err := DetectFirewallBackend(context.Background(), "/proc/1234/ns/net")
+	if err != nil {
+		t.Fatalf("DetectFirewallBackend: %v", err)
+	}
+	if _, ok := backend.(*iptablesClient); !ok {
+		t.Errorf("expected an iptablesClient override to return one, got %T", backend)
+	}
+
+	FirewallBackendOverride = "not-a-real-backend"
+	if _, err := DetectFirewallBackend(context.Background(), "/proc/1234/ns/net"); err == nil {
+		t.Errorf("expected an error for an unknown override")
+	}
+}
+
+func TestTableName(t *testing.T) {
+	cases := []struct {
+		in   pb.Chain_Table
+		want string
+	}{
+		{pb.Chain_FILTER, filterTable},
+		{pb.Chain_NAT, natTable},
+		{pb.Chain_MANGLE, mangleTable},
+	}
+
+	for _, c := range cases {
+		if got := tableName(c.in); got != c.want {
+			t.Errorf("tableName(%v) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestFirewallChainsForTable(t *testing.T) {
+	cases := []struct {
+		table string
+		want  []string
+	}{
+		{filterTable, []string{"INPUT", "OUTPUT"}},
+		{natTable, []string{"PREROUTING", "POSTROUTING"}},
+		{mangleTable, []string{"PREROUTING", "POSTROUTING", "FORWARD"}},
+	}
+
+	for _, c := range cases {
+		got := firewallChainsForTable(c.table)
+		if len(got) != len(c.want) {
+			t.Fatalf("firewallChainsForTable(%q) = %v, want %v", c.table, got, c.want)
+		}
+		for i := range c.want {
+			if got[i] != c.want[i] {
+				t.Errorf("firewallChainsForTable(%q)[%d] = %q, want %q", c.table, i, got[i], c.want[i])
+			}
+		}
+	}
+}
+
+func TestRealChainForDirection(t *testing.T) {
+	cases := []struct {
+		in   pb.Chain_Direction
+		want string
+	}{
+		{pb.Chain_INPUT, "INPUT"},
+		{pb.Chain_OUTPUT, "OUTPUT"},
+		{pb.Chain_PREROUTING, "PREROUTING"},
+		{pb.Chain_POSTROUTING, "POSTROUTING"},
+		{pb.Chain_FORWARD, "FORWARD"},
+	}
+
+	for _, c := range cases {
+		got, err := realChainForDirection(c.in)
+		if err != nil {
+			t.Fatalf("realChainForDirection(%v): %v", c.in, err)
+		}
+		if got != c.want {
+			t.Errorf("realChainForDirection(%v) = %q, want %q", c.in, got, c.want)
+		}
+	}
+
+	if _, err := realChainForDirection(pb.Chain_Direction(99)); err == nil {
+		t.Errorf("expected an error for an unknown direction")
+	}
+}
+
+func TestIpsetMatchDirection(t *testing.T) {
+	cases := []struct {
+		in   pb.Chain_Direction
+		want string
+	}{
+		{pb.Chain_INPUT, "src"},
+		{pb.Chain_PREROUTING, "src"},
+		{pb.Chain_FORWARD, "src"},
+		{pb.Chain_OUTPUT, "dst"},
+		{pb.Chain_POSTROUTING, "dst"},
+	}
+
+	for _, c := range cases {
+		if got := ipsetMatchDirection(c.in); got != c.want {
+			t.Errorf("ipsetMatchDirection(%v) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestChainDirectionAllowedForTable(t *testing.T) {
+	cases := []struct {
+		realChain string
+		table     string
+		want      bool
+	}{
+		{"INPUT", filterTable, true},
+		{"OUTPUT", filterTable, true},
+		{"INPUT", natTable, false},
+		{"PREROUTING", natTable, true},
+		{"FORWARD", mangleTable, true},
+		{"FORWARD", filterTable, false},
+	}
+
+	for _, c := range cases {
+		if got := chainDirectionAllowedForTable(c.realChain, c.table); got != c.want {
+			t.Errorf("chainDirectionAllowedForTable(%q, %q) = %v, want %v", c.realChain, c.table, got, c.want)
+		}
+	}
+}
+
+func TestApplyFirewallChainRejectsMismatchedDirectionAndTable(t *testing.T) {
+	iptables := buildIptablesClient(context.Background(), "/proc/1234/ns/net", ipv4, natTable)
+	chain := &pb.Chain{
+		Name:      "CHAOS-RULE-0",
+		Direction: pb.Chain_INPUT,
+		Table:     pb.Chain_NAT,
+		Target:    "DROP",
+	}
+
+	if err := applyFirewallChain(iptables, chain, ipv4); err == nil {
+		t.Fatalf("expected an error for Direction=INPUT in the nat table")
+	}
+}
+
+func TestTargetClause(t *testing.T) {
+	cases := []struct {
+		name  string
+		chain *pb.Chain
+		want  string
+	}{
+		{"no target params", &pb.Chain{Target: "DROP"}, ""},
+		{"dnat", &pb.Chain{Target: "DNAT", ToDestination: "10.0.0.5:8080"}, " --to-destination 10.0.0.5:8080"},
+		{"snat", &pb.Chain{Target: "SNAT", ToSource: "10.0.0.5"}, " --to-source 10.0.0.5"},
+		{"mark", &pb.Chain{Target: "MARK", MarkValue: "0x1"}, " --set-mark 0x1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := targetClause(c.chain); got != c.want {
+				t.Errorf("targetClause(%+v) = %q, want %q", c.chain, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaosd
+
+import (
+	"context"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/pingcap/errors"
+)
+
+const (
+	firewalldBusName     = "org.fedoraproject.FirewallD1"
+	firewalldObjectPath  = "/org/fedoraproject/FirewallD1"
+	firewalldDirectIface = firewalldBusName + ".direct"
+
+	firewalldIPv      = "ipv4"
+	firewalldTable    = "filter"
+	firewalldPriority = 0
+)
+
+// firewalldClient drives firewalld's "direct" D-Bus interface, which exists
+// precisely so other daemons can register raw iptables-style chains and rules
+// without firewalld reloading over and silently dropping them. It talks to the
+// single system-wide firewalld instance, so unlike iptablesClient/nftablesClient
+// it cannot be scoped to a container's network namespace: the rules it installs
+// apply to the host's own network stack.
+type firewalldClient struct {
+	ctx  context.Context
+	conn *dbus.Conn
+	obj  dbus.BusObject
+}
+
+// buildFirewalldClient connects to the system D-Bus and confirms firewalld is
+// actually running there before handing back a client. DetectFirewallBackend
+// only calls it for an explicit firewalld override and returns its error as is,
+// without falling back to iptables.
+func buildFirewalldClient(ctx context.Context, nsPath string) (*firewalldClient, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	obj := conn.Object(firewalldBusName, dbus.ObjectPath(firewalldObjectPath))
+	if err := obj.CallWithContext(ctx, firewalldBusName+".getVersion", 0).Err; err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &firewalldClient{ctx: ctx, conn: conn, obj: obj}, nil
+}
+
+// EnsureChain implements FirewallBackend.
+func (f *firewalldClient) EnsureChain(chainName string) error {
+	call := f.obj.CallWithContext(f.ctx, firewalldDirectIface+".addChain", 0,
+		firewalldIPv, firewalldTable, chainName)
+	if call.Err != nil && !isFirewalldAlreadyEnabledErr(call.Err) {
+		return errors.WithStack(call.Err)
+	}
+	return nil
+}
+
+// EnsureRule implements FirewallBackend. rule is translated from iptables syntax
+// into the argv firewalld's direct interface expects, which is the same token
+// list iptables itself would take after "-A <chain>".
+func (f *firewalldClient) EnsureRule(chainName, rule string) error {
+	args := firewalldRuleArgs(chainName, rule)
+
+	queried := f.obj.CallWithContext(f.ctx, firewalldDirectIface+".queryRule", 0,
+		firewalldIPv, firewalldTable, chainName, firewalldPriority, args)
+	if queried.Err == nil {
+		var exists bool
+		if err := queried.Store(&exists); err == nil && exists {
+			return nil
+		}
+	}
+
+	call := f.obj.CallWithContext(f.ctx, firewalldDirectIface+".addRule", 0,
+		firewalldIPv, firewalldTable, chainName, firewalldPriority, args)
+	if call.Err != nil && !isFirewalldAlreadyEnabledErr(call.Err) {
+		return errors.WithStack(call.Err)
+	}
+	return nil
+}
+
+// FlushChain implements FirewallBackend.
+func (f *firewalldClient) FlushChain(chainName string) error {
+	call := f.obj.CallWithContext(f.ctx, firewalldDirectIface+".removeRules", 0,
+		firewalldIPv, firewalldTable, chainName)
+	if call.Err != nil {
+		return errors.WithStack(call.Err)
+	}
+	return nil
+}
+
+// DeleteChain implements FirewallBackend.
+func (f *firewalldClient) DeleteChain(chainName string) error {
+	if err := f.FlushChain(chainName); err != nil {
+		return err
+	}
+
+	call := f.obj.CallWithContext(f.ctx, firewalldDirectIface+".removeChain", 0,
+		firewalldIPv, firewalldTable, chainName)
+	if call.Err != nil {
+		return errors.WithStack(call.Err)
+	}
+	return nil
+}
+
+// Flush implements FirewallBackend. Every direct-interface call above already
+// takes effect immediately, so there is nothing left to commit.
+func (f *firewalldClient) Flush() error {
+	return nil
+}
+
+// firewalldRuleArgs strips the leading "-A <chain>" off an iptables-syntax rule
+// string, since firewalld's direct interface is given the chain separately and
+// only wants the remaining match/target tokens.
+func firewalldRuleArgs(chainName, rule string) []string {
+	fields := splitRuleFields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "-A" && fields[i+1] == chainName {
+			return fields[i+2:]
+		}
+	}
+	return fields
+}
+
+// isFirewalldAlreadyEnabledErr reports whether err is firewalld's
+// ALREADY_ENABLED D-Bus error, which it returns for a chain or rule that already
+// exists; chaosd treats that the same as success.
+func isFirewalldAlreadyEnabledErr(err error) bool {
+	dbusErr, ok := err.(dbus.Error)
+	if !ok {
+		return false
+	}
+	return dbusErr.Name == firewalldBusName+".Exception" && len(dbusErr.Body) > 0 &&
+		dbusErr.Body[0] == "ALREADY_ENABLED"
+}
@@ -14,10 +14,17 @@
 package chaosd
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
 	"github.com/pingcap/errors"
@@ -28,9 +35,37 @@ import (
 )
 
 const (
-	iptablesCmd = "iptables"
+	iptablesCmd        = "iptables"
+	iptablesRestoreCmd = "iptables-restore"
 
-	iptablesChainAlreadyExistErr = "iptables: Chain already exists."
+	ip6tablesCmd        = "ip6tables"
+	ip6tablesRestoreCmd = "ip6tables-restore"
+
+	filterTable = "filter"
+	natTable    = "nat"
+	mangleTable = "mangle"
+)
+
+// tableName maps a chain's requested table to the iptables table name it should
+// be reconciled in. The zero value of pb.Chain_Table is FILTER, so requests
+// predating the Table field keep going to the filter table exactly as before.
+func tableName(table pb.Chain_Table) string {
+	switch table {
+	case pb.Chain_NAT:
+		return natTable
+	case pb.Chain_MANGLE:
+		return mangleTable
+	default:
+		return filterTable
+	}
+}
+
+// ipVersion selects which IP stack an iptablesClient drives.
+type ipVersion int
+
+const (
+	ipv4 ipVersion = iota
+	ipv6
 )
 
 func (s *Server) SetContainerIptablesChains(ctx context.Context, req *pb.IptablesChainsRequest) error {
@@ -42,25 +77,145 @@ func (s *Server) SetContainerIptablesChains(ctx context.Context, req *pb.Iptable
 
 	nsPath := GetNsPath(pid, bpm.NetNS)
 
-	iptables := buildIptablesClient(ctx, nsPath)
-	err = iptables.initializeEnv()
-	if err != nil {
-		log.Error("failed to initialize iptables", zap.Error(err))
-		return errors.WithStack(err)
+	// ip6tables is the only backend with IPv6 parity so far, so V6/BOTH chains
+	// always go through it regardless of which backend was picked for V4; nft and
+	// firewalld are only consulted for V4 until they grow the same support.
+	// Likewise, the nat and mangle tables are only reachable through iptables
+	// itself: nftablesClient/firewalldClient only ever provision the filter
+	// table's INPUT/OUTPUT path, so any chain with a non-filter Table forces the
+	// iptables/ip6tables backend regardless of what DetectFirewallBackend would
+	// otherwise pick for plain filter-table chains.
+	type backendKey struct {
+		version ipVersion
+		table   string
 	}
+	backends := map[backendKey]FirewallBackend{}
+	backendFor := func(version ipVersion, table string) (FirewallBackend, error) {
+		key := backendKey{version, table}
+		if b, ok := backends[key]; ok {
+			return b, nil
+		}
 
-	err = iptables.setIptablesChains(req.Chains)
-	if err != nil {
-		log.Error("failed to set iptables chains", zap.Error(err))
-		return errors.WithStack(err)
+		var (
+			backend FirewallBackend
+			err     error
+		)
+		if version == ipv6 || table != filterTable {
+			backend = buildIptablesClient(ctx, nsPath, version, table)
+		} else {
+			backend, err = DetectFirewallBackend(ctx, nsPath)
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if err := initializeFirewallEnv(backend, version, table); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		backends[key] = backend
+
+		return backend, nil
+	}
+
+	for _, chain := range req.Chains {
+		table := tableName(chain.Table)
+
+		switch chain.IPVersion {
+		case pb.Chain_V6:
+			backend, err := backendFor(ipv6, table)
+			if err != nil {
+				log.Error("failed to initialize ip6tables", zap.Error(err))
+				return err
+			}
+			if err := applyFirewallChain(backend, chain, ipv6); err != nil {
+				log.Error("failed to set ip6tables chain", zap.Error(err))
+				return errors.WithStack(err)
+			}
+		case pb.Chain_BOTH:
+			v4, err := backendFor(ipv4, table)
+			if err != nil {
+				log.Error("failed to initialize the v4 firewall backend", zap.Error(err))
+				return err
+			}
+			v6, err := backendFor(ipv6, table)
+			if err != nil {
+				log.Error("failed to initialize ip6tables", zap.Error(err))
+				return err
+			}
+
+			// The iptables/ip6tables backends only stage here and touch nothing
+			// in the kernel before Flush, so there is nothing of theirs to roll
+			// back if a later chain in this request fails. An nftables v4 backend
+			// applies each change as it runs, and those changes are not undone.
+			// Every chain's staged changes accumulate and commit through the
+			// single batched Flush loop below, the same as the V4/V6-only branches.
+			if err := applyFirewallChain(v4, chain, ipv4); err != nil {
+				log.Error("failed to set the v4 firewall chain", zap.Error(err))
+				return errors.WithStack(err)
+			}
+			if err := applyFirewallChain(v6, chain, ipv6); err != nil {
+				log.Error("failed to set ip6tables chain", zap.Error(err))
+				return errors.WithStack(err)
+			}
+		default: // pb.Chain_V4, and the zero value for requests predating IPVersion
+			backend, err := backendFor(ipv4, table)
+			if err != nil {
+				log.Error("failed to initialize the v4 firewall backend", zap.Error(err))
+				return err
+			}
+			if err := applyFirewallChain(backend, chain, ipv4); err != nil {
+				log.Error("failed to set the v4 firewall chain", zap.Error(err))
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	flushed := make([]FirewallBackend, 0, len(backends))
+	for _, backend := range backends {
+		if err := backend.Flush(); err != nil {
+			log.Error("failed to flush firewall backend, rolling back previously flushed backends", zap.Error(err))
+			for _, fb := range flushed {
+				rollbackFirewallBackend(fb)
+			}
+			return errors.WithStack(err)
+		}
+		flushed = append(flushed, backend)
 	}
 
 	return nil
 }
 
 type iptablesClient struct {
-	ctx    context.Context
-	nsPath string
+	ctx            context.Context
+	nsPath         string
+	table          string
+	ipVersion      ipVersion
+	cmdName        string
+	restoreCmdName string
+
+	// runCommand runs name (cmdName or restoreCmdName) with args inside this
+	// client's netns, piping stdin to it if non-nil, and returns its combined
+	// stdout+stderr. It is a field rather than a direct bpm call so unit tests
+	// can replace it with a fake that never actually switches network
+	// namespaces, instead of depending on SetNetNS being a no-op for a
+	// fabricated nsPath the way the real bpm package's is not.
+	runCommand func(name string, stdin io.Reader, args ...string) ([]byte, error)
+
+	cache *iptablesTableCache
+	// pendingChains holds the desired full rule set of every chain touched during
+	// this reconcile, keyed by chain name. Flush diffs it against cache.chains and
+	// emits only the iptables-restore lines needed to get from one to the other.
+	pendingChains map[string]*iptablesChain
+	// priorChains snapshots the state of every chain the first time this client
+	// touches it since the last Flush, so Rollback can restore it.
+	priorChains map[string]*iptablesChain
+	// lastCommitted holds the priorChains snapshot from the most recently
+	// successful Flush. Flush resets priorChains to nil once it commits, to start
+	// tracking the next reconcile's touches, so without this Rollback would have
+	// nothing left to undo a commit that already landed — exactly the case where a
+	// dual-stack BOTH reconcile flushes the v4 side, then fails on v6 and needs to
+	// roll the v4 side back.
+	lastCommitted map[string]*iptablesChain
 }
 
 type iptablesChain struct {
@@ -68,161 +223,504 @@ type iptablesChain struct {
 	Rules []string
 }
 
-func buildIptablesClient(ctx context.Context, nsPath string) *iptablesClient {
-	return &iptablesClient{
-		ctx,
-		nsPath,
-	}
+// iptablesTableCache is the in-memory view of every chain and rule chaosd has last
+// observed for a single (netns, table) pair. It is populated once, lazily, from
+// `iptables -S` and then kept up to date by Flush, so a reconcile only forks a new
+// iptables process when there is an actual diff to apply.
+type iptablesTableCache struct {
+	mu     sync.Mutex
+	loaded bool
+	chains map[string]*iptablesChain
 }
 
-func (iptables *iptablesClient) setIptablesChains(chains []*pb.Chain) error {
-	for _, chain := range chains {
-		err := iptables.setIptablesChain(chain)
-		if err != nil {
-			return err
-		}
+var (
+	iptablesCachesMu sync.Mutex
+	iptablesCaches   = map[string]*iptablesTableCache{}
+)
+
+func iptablesCacheKey(nsPath, table string) string {
+	return nsPath + "|" + table
+}
+
+func getIptablesTableCache(nsPath, table string) *iptablesTableCache {
+	iptablesCachesMu.Lock()
+	defer iptablesCachesMu.Unlock()
+
+	key := iptablesCacheKey(nsPath, table)
+	c, ok := iptablesCaches[key]
+	if !ok {
+		c = &iptablesTableCache{}
+		iptablesCaches[key] = c
 	}
 
-	return nil
+	return c
 }
 
-func (iptables *iptablesClient) setIptablesChain(chain *pb.Chain) error {
-	var matchPart string
-	if chain.Direction == pb.Chain_INPUT {
-		matchPart = "src"
-	} else if chain.Direction == pb.Chain_OUTPUT {
-		matchPart = "dst"
-	} else {
-		return fmt.Errorf("unknown chain direction %d", chain.Direction)
+// InvalidateIptablesCache drops the cached (netns, table) state of both iptables
+// and ip6tables, forcing the next reconcile to re-read it from `iptables -S`.
+// Callers should invoke this whenever rules for a container may have changed
+// outside of chaosd's own reconcile loop.
+func InvalidateIptablesCache(nsPath, table string) {
+	for _, cmdName := range []string{iptablesCmd, ip6tablesCmd} {
+		// Same key form as iptablesClient.cacheKey.
+		c := getIptablesTableCache(nsPath, table+":"+cmdName)
+		c.mu.Lock()
+		c.loaded = false
+		c.chains = nil
+		c.mu.Unlock()
 	}
+}
 
-	protocolAndPort := chain.Protocol
-	if len(protocolAndPort) > 0 {
-		if len(chain.SourcePorts) > 0 {
-			protocolAndPort += " " + chain.SourcePorts
-		}
+// releaseIptablesState removes this (netns, table) pair's entry from
+// iptablesCaches, and nsPath's entry from netnsLocks, entirely, instead of
+// merely resetting the cache's contents the way InvalidateIptablesCache does.
+// nsPath is derived from a container's ephemeral PID and never reused, so
+// without this a long-running chaosd managing a continuous stream of
+// short-lived containers would leak one cache entry and one mutex per
+// container forever. Called from DeleteChain, chaosd's only container-teardown
+// hook for this backend; a mutex still held by an in-flight call for nsPath
+// when its entry is deleted keeps working correctly, since the old mutex
+// value still guards it — a later call for the same nsPath just gets a new
+// one.
+func releaseIptablesState(nsPath, cacheKey string) {
+	iptablesCachesMu.Lock()
+	delete(iptablesCaches, iptablesCacheKey(nsPath, cacheKey))
+	iptablesCachesMu.Unlock()
+
+	netnsLocks.Delete(nsPath)
+}
+
+// netnsLocks holds one *sync.Mutex per container netns that chaosd has touched.
+// Every iptables/ip6tables invocation still passes -w and waits on the real,
+// host-wide /run/xtables.lock, since it is not confirmed that each container's
+// netns also gets its own isolated mount namespace (and therefore its own lock
+// file) in every deployment chaosd targets; -w remains what guarantees
+// correctness against concurrent writers outside this process. netnsLocks only
+// cuts out unnecessary serialization between chaosd's own requests for different
+// containers and reports how long they waited on each other, on top of whatever
+// time -w itself still spends waiting on the physical lock.
+var netnsLocks sync.Map // nsPath -> *sync.Mutex
+
+var iptablesNetnsLockWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "chaosd",
+	Subsystem: "iptables",
+	Name:      "netns_lock_wait_seconds",
+	Help:      "Time spent waiting to acquire chaosd's in-process per-netns iptables lock.",
+	Buckets:   prometheus.DefBuckets,
+})
+
+func init() {
+	prometheus.MustRegister(iptablesNetnsLockWaitSeconds)
+}
 
-		if len(chain.DestinationPorts) > 0 {
-			protocolAndPort += " " + chain.DestinationPorts
+func netnsLock(nsPath string) *sync.Mutex {
+	lock, _ := netnsLocks.LoadOrStore(nsPath, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// withNetnsLock runs fn while holding the in-process lock for nsPath, recording
+// how long it waited so operators can tell how much of their latency is chaosd
+// serializing its own requests versus -w waiting on /run/xtables.lock itself.
+// Different containers' netns's proceed in parallel; calls for the same netns
+// are still ordered.
+func withNetnsLock(nsPath string, fn func() error) error {
+	lock := netnsLock(nsPath)
+
+	waitStart := time.Now()
+	lock.Lock()
+	defer lock.Unlock()
+	iptablesNetnsLockWaitSeconds.Observe(time.Since(waitStart).Seconds())
+
+	return fn()
+}
+
+func buildIptablesClient(ctx context.Context, nsPath string, version ipVersion, table string) *iptablesClient {
+	cmdName, restoreCmdName := iptablesCmd, iptablesRestoreCmd
+	if version == ipv6 {
+		cmdName, restoreCmdName = ip6tablesCmd, ip6tablesRestoreCmd
+	}
+
+	client := &iptablesClient{
+		ctx:            ctx,
+		nsPath:         nsPath,
+		table:          table,
+		ipVersion:      version,
+		cmdName:        cmdName,
+		restoreCmdName: restoreCmdName,
+	}
+	client.runCommand = func(name string, stdin io.Reader, args ...string) ([]byte, error) {
+		cmd := bpm.DefaultProcessBuilder(name, args...).SetNetNS(nsPath).SetContext(ctx).Build()
+		if stdin != nil {
+			cmd.Stdin = stdin
 		}
+		return cmd.CombinedOutput()
 	}
+	client.cache = getIptablesTableCache(nsPath, client.cacheKey())
+
+	return client
+}
+
+// cacheKey is the table part of this client's key in the process-wide
+// iptablesCaches map; getIptablesTableCache pairs it with nsPath. It is keyed on
+// cmdName rather than ipVersion directly so
+// iptables and ip6tables never share a cache even though both can target the same
+// nominal table name.
+func (iptables *iptablesClient) cacheKey() string {
+	return iptables.table + ":" + iptables.cmdName
+}
 
-	rules := []string{}
-	for _, ipset := range chain.Ipsets {
-		rules = append(rules, fmt.Sprintf("-A %s -m set --match-set %s %s -j %s -w 5 %s",
-			chain.Name, ipset, matchPart, chain.Target, protocolAndPort))
+// chaosChainName returns the jump chain chaosd manages for direction ("INPUT" or
+// "OUTPUT") on this client's IP stack. ip6tables keeps its own INPUT/OUTPUT chain
+// namespace, so the v6 jump chains only need a distinct suffix to avoid aliasing
+// rules between the v4 and v6 reconciles that share this chaosd process.
+func (iptables *iptablesClient) chaosChainName(direction string) string {
+	if iptables.ipVersion == ipv6 {
+		return "CHAOS-" + direction + "6"
 	}
-	err := iptables.createNewChain(&iptablesChain{
-		Name:  chain.Name,
-		Rules: rules,
-	})
-	if err != nil {
-		return errors.WithStack(err)
+	return "CHAOS-" + direction
+}
+
+// loadCache populates the cache for this client's (netns, table) pair from the live
+// iptables state, forking a single `iptables -S` process. It is a no-op once the
+// cache has been loaded, until it is invalidated.
+func (iptables *iptablesClient) loadCache() error {
+	iptables.cache.mu.Lock()
+	defer iptables.cache.mu.Unlock()
+
+	if iptables.cache.loaded {
+		return nil
 	}
 
-	if chain.Direction == pb.Chain_INPUT {
-		err := iptables.ensureRule(&iptablesChain{
-			Name: "CHAOS-INPUT",
-		}, "-A CHAOS-INPUT -j "+chain.Name)
+	return withNetnsLock(iptables.nsPath, func() error {
+		out, err := iptables.runCommand(iptables.cmdName, nil, "-w", "-t", iptables.table, "-S")
 		if err != nil {
-			return errors.WithStack(err)
+			return encodeOutputToError(out, err)
 		}
-	} else if chain.Direction == pb.Chain_OUTPUT {
-		iptables.ensureRule(&iptablesChain{
-			Name: "CHAOS-OUTPUT",
-		}, "-A CHAOS-OUTPUT -j "+chain.Name)
-		if err != nil {
-			return errors.WithStack(err)
+
+		chains := map[string]*iptablesChain{}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			fields := splitRuleFields(line)
+			if len(fields) < 2 {
+				continue
+			}
+
+			name := fields[1]
+			chain, ok := chains[name]
+			if !ok {
+				chain = &iptablesChain{Name: name}
+				chains[name] = chain
+			}
+
+			if fields[0] == "-A" {
+				chain.Rules = append(chain.Rules, normalizeRule(line))
+			}
 		}
-	} else {
-		return fmt.Errorf("unknown direction %d", chain.Direction)
-	}
-	return nil
+
+		iptables.cache.chains = chains
+		iptables.cache.loaded = true
+
+		return nil
+	})
 }
 
-func (iptables *iptablesClient) initializeEnv() error {
-	for _, direction := range []string{"INPUT", "OUTPUT"} {
-		chainName := "CHAOS-" + direction
+// createNewChain will cover existing chain
+func (iptables *iptablesClient) createNewChain(chain *iptablesChain) error {
+	return iptables.stageChain(chain)
+}
 
-		err := iptables.createNewChain(&iptablesChain{
-			Name:  chainName,
-			Rules: []string{},
-		})
-		if err != nil {
-			return err
-		}
+// deleteAndWriteRules will remove all existing rules in the chain and replace them
+// with the new settings, once Flush is called.
+func (iptables *iptablesClient) deleteAndWriteRules(chain *iptablesChain) error {
+	return iptables.stageChain(chain)
+}
 
-		iptables.ensureRule(&iptablesChain{
-			Name:  direction,
-			Rules: []string{},
-		}, "-A "+direction+" -j "+chainName)
+// stageChain records the full desired rule set for chain so Flush can diff it
+// against the cached live state in a single batch, instead of each caller forking
+// its own iptables process immediately.
+func (iptables *iptablesClient) stageChain(chain *iptablesChain) error {
+	if err := iptables.loadCache(); err != nil {
+		return err
 	}
 
+	normalized := make([]string, len(chain.Rules))
+	for i, rule := range chain.Rules {
+		normalized[i] = normalizeRule(rule)
+	}
+
+	iptables.snapshotPrior(chain.Name)
+
+	if iptables.pendingChains == nil {
+		iptables.pendingChains = map[string]*iptablesChain{}
+	}
+	iptables.pendingChains[chain.Name] = &iptablesChain{Name: chain.Name, Rules: normalized}
+
 	return nil
 }
 
-// createNewChain will cover existing chain
-func (iptables *iptablesClient) createNewChain(chain *iptablesChain) error {
-	cmd := bpm.DefaultProcessBuilder(iptablesCmd, "-w", "-N", chain.Name).SetNetNS(iptables.nsPath).SetContext(iptables.ctx).Build()
-	out, err := cmd.CombinedOutput()
+// snapshotPrior records chain's state as it was before this reconcile first
+// touched it, the first time it is touched, so Rollback can restore it later.
+func (iptables *iptablesClient) snapshotPrior(name string) {
+	if iptables.priorChains == nil {
+		iptables.priorChains = map[string]*iptablesChain{}
+	}
+	if _, ok := iptables.priorChains[name]; ok {
+		return
+	}
 
-	if (err == nil && len(out) == 0) ||
-		(err != nil && strings.Contains(string(out), iptablesChainAlreadyExistErr)) {
-		// Successfully create a new chain
-		return iptables.deleteAndWriteRules(chain)
+	iptables.cache.mu.Lock()
+	existing := iptables.cache.chains[name]
+	iptables.cache.mu.Unlock()
+
+	if existing == nil {
+		iptables.priorChains[name] = &iptablesChain{Name: name}
+		return
 	}
+	iptables.priorChains[name] = &iptablesChain{Name: name, Rules: append([]string{}, existing.Rules...)}
+}
 
-	return encodeOutputToError(out, err)
+// rollbackSource picks which snapshot Rollback should restore from: chains
+// staged but not yet flushed take priority, since they represent this client's
+// most recent touch; failing that, the pre-commit snapshot of the last
+// successful Flush is all that's left to undo.
+func rollbackSource(priorChains, lastCommitted map[string]*iptablesChain) map[string]*iptablesChain {
+	if len(priorChains) > 0 {
+		return priorChains
+	}
+	return lastCommitted
 }
 
-// deleteAndWriteRules will remove all existing function in the chain
-// and replace with the new settings
-func (iptables *iptablesClient) deleteAndWriteRules(chain *iptablesChain) error {
+// Rollback restores every chain this client has touched back to the state it had
+// before, e.g. when a dual-stack BOTH reconcile fails on the ip6tables side and
+// the iptables side must not be left half-applied. It restores whichever is
+// still outstanding: chains staged but not yet flushed (priorChains), or, if
+// those have already landed via a successful Flush, the snapshot Flush kept of
+// that commit (lastCommitted).
+func (iptables *iptablesClient) Rollback() error {
+	undo := rollbackSource(iptables.priorChains, iptables.lastCommitted)
+	if len(undo) == 0 {
+		return nil
+	}
 
-	// This chain should already exist
-	err := iptables.flushIptablesChain(chain)
-	if err != nil {
+	iptables.pendingChains = undo
+	iptables.priorChains = nil
+	iptables.lastCommitted = nil
+
+	return iptables.Flush()
+}
+
+func (iptables *iptablesClient) ensureRule(chain *iptablesChain, rule string) error {
+	if err := iptables.loadCache(); err != nil {
 		return err
 	}
 
-	for _, rule := range chain.Rules {
-		err := iptables.ensureRule(chain, rule)
-		if err != nil {
-			return err
+	normalized := normalizeRule(rule)
+
+	iptables.snapshotPrior(chain.Name)
+
+	if iptables.pendingChains == nil {
+		iptables.pendingChains = map[string]*iptablesChain{}
+	}
+
+	staged, ok := iptables.pendingChains[chain.Name]
+	if !ok {
+		iptables.cache.mu.Lock()
+		existing := iptables.cache.chains[chain.Name]
+		iptables.cache.mu.Unlock()
+
+		rules := []string{}
+		if existing != nil {
+			rules = append(rules, existing.Rules...)
 		}
+		staged = &iptablesChain{Name: chain.Name, Rules: rules}
+		iptables.pendingChains[chain.Name] = staged
 	}
 
+	for _, existingRule := range staged.Rules {
+		if existingRule == normalized {
+			// The required rule already exists in the chain
+			return nil
+		}
+	}
+
+	staged.Rules = append(staged.Rules, normalized)
+
 	return nil
 }
 
-func (iptables *iptablesClient) ensureRule(chain *iptablesChain, rule string) error {
-	cmd := bpm.DefaultProcessBuilder(iptablesCmd, "-w", "-S", chain.Name).SetNetNS(iptables.nsPath).SetContext(iptables.ctx).Build()
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return encodeOutputToError(out, err)
+// Flush reconciles every chain staged during this reconcile against the cached live
+// state, piping the minimum set of `:chain` declarations and `-A`/`-D` lines needed
+// to reach the desired state through a single `iptables-restore --noflush` call.
+func (iptables *iptablesClient) Flush() error {
+	iptables.cache.mu.Lock()
+	defer iptables.cache.mu.Unlock()
+
+	if len(iptables.pendingChains) == 0 {
+		return nil
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "*%s\n", iptables.table)
+
+	changed := false
+	for name, desired := range iptables.pendingChains {
+		current := iptables.cache.chains[name]
+		if current == nil {
+			fmt.Fprintf(&script, ":%s - [0:0]\n", name)
+			current = &iptablesChain{Name: name}
+			changed = true
+		}
+
+		desiredSet := map[string]bool{}
+		for _, rule := range desired.Rules {
+			desiredSet[rule] = true
+		}
+
+		for _, rule := range current.Rules {
+			if !desiredSet[rule] {
+				fmt.Fprintf(&script, "-D %s\n", strings.TrimPrefix(rule, "-A "))
+				changed = true
+			}
+		}
+
+		currentSet := map[string]bool{}
+		for _, rule := range current.Rules {
+			currentSet[rule] = true
+		}
+		for _, rule := range desired.Rules {
+			if !currentSet[rule] {
+				fmt.Fprintf(&script, "%s\n", rule)
+				changed = true
+			}
+		}
+
+		iptables.cache.chains[name] = desired
 	}
+	script.WriteString("COMMIT\n")
+
+	committedPrior := iptables.priorChains
+	iptables.pendingChains = nil
+	iptables.priorChains = nil
 
-	if strings.Contains(string(out), rule) {
-		// The required rule already exist in chain
+	if !changed {
 		return nil
 	}
 
-	// TODO: lock on every container but not on chaos-daemon's `/run/xtables.lock`
-	cmd = bpm.DefaultProcessBuilder(iptablesCmd, strings.Split("-w "+rule, " ")...).SetNetNS(iptables.nsPath).SetContext(iptables.ctx).Build()
-	out, err = cmd.CombinedOutput()
+	err := withNetnsLock(iptables.nsPath, func() error {
+		out, err := iptables.runCommand(iptables.restoreCmdName, strings.NewReader(script.String()), "-w", "--noflush")
+		if err != nil {
+			// The live state no longer matches what we think we know; force the next
+			// reconcile to re-read it from iptables rather than trusting the cache.
+			iptables.cache.loaded = false
+			iptables.cache.chains = nil
+			return encodeOutputToError(out, err)
+		}
+
+		return nil
+	})
 	if err != nil {
-		return encodeOutputToError(out, err)
+		return err
 	}
 
+	// Keep what this commit changed so a later Rollback can still undo it, even
+	// though priorChains above has already been reset to track the next
+	// reconcile's touches.
+	iptables.lastCommitted = committedPrior
+
 	return nil
 }
 
-func (iptables *iptablesClient) flushIptablesChain(chain *iptablesChain) error {
-	cmd := bpm.DefaultProcessBuilder(iptablesCmd, "-w", "-F", chain.Name).SetNetNS(iptables.nsPath).SetContext(iptables.ctx).Build()
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return encodeOutputToError(out, err)
+// EnsureChain implements FirewallBackend. Like createNewChain it stages chainName
+// as empty, so an existing chain's rules are removed on the next Flush unless
+// EnsureRule adds them back before it.
+func (iptables *iptablesClient) EnsureChain(chainName string) error {
+	return iptables.createNewChain(&iptablesChain{Name: chainName})
+}
+
+// EnsureRule implements FirewallBackend.
+func (iptables *iptablesClient) EnsureRule(chainName, rule string) error {
+	return iptables.ensureRule(&iptablesChain{Name: chainName}, rule)
+}
+
+// FlushChain implements FirewallBackend by staging chainName back to empty; the
+// flush itself happens on the next call to Flush.
+func (iptables *iptablesClient) FlushChain(chainName string) error {
+	return iptables.stageChain(&iptablesChain{Name: chainName})
+}
+
+// DeleteChain implements FirewallBackend. Chain teardown is rare compared to the
+// additive path above, so it isn't worth batching through Flush: it runs directly
+// and invalidates the cache so the next reconcile sees the chain is gone.
+func (iptables *iptablesClient) DeleteChain(chainName string) error {
+	return withNetnsLock(iptables.nsPath, func() error {
+		if out, err := iptables.runCommand(iptables.cmdName, nil, "-w", "-t", iptables.table, "-F", chainName); err != nil {
+			return encodeOutputToError(out, err)
+		}
+
+		if out, err := iptables.runCommand(iptables.cmdName, nil, "-w", "-t", iptables.table, "-X", chainName); err != nil {
+			return encodeOutputToError(out, err)
+		}
+
+		releaseIptablesState(iptables.nsPath, iptables.cacheKey())
+
+		return nil
+	})
+}
+
+// normalizeRule canonicalizes whitespace and quoting in a rule spec so that rules
+// built by applyFirewallChain can be compared against the textual output of
+// `iptables -S`, which is otherwise fragile to compare byte-for-byte. It also
+// strips the -w/--wait lock-wait flag: -w is a CLI-only option to the iptables
+// binary, never stored in the kernel ruleset, so `iptables -S` never echoes it
+// back. Without stripping it here, every rule loadCache reads from a live system
+// would be missing the "-w 5" token applyFirewallChain embeds in the rules it
+// builds, and Flush's set comparison would treat every already-correct rule as
+// changed.
+func normalizeRule(rule string) string {
+	return strings.Join(stripWaitFlag(splitRuleFields(rule)), " ")
+}
+
+// stripWaitFlag removes a "-w"/"--wait" lock-wait flag, and its optional numeric
+// seconds argument, from fields.
+func stripWaitFlag(fields []string) []string {
+	out := make([]string, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "-w", "--wait":
+			if i+1 < len(fields) {
+				if _, err := strconv.Atoi(fields[i+1]); err == nil {
+					i++
+				}
+			}
+		default:
+			out = append(out, fields[i])
+		}
 	}
+	return out
+}
 
-	return nil
+func splitRuleFields(rule string) []string {
+	var fields []string
+	var cur strings.Builder
+	inQuote := false
+
+	for _, r := range rule {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case r == ' ' && !inQuote:
+			if cur.Len() > 0 {
+				fields = append(fields, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		fields = append(fields, cur.String())
+	}
+
+	return fields
 }
@@ -0,0 +1,88 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaosd
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestFlushRetainsLastCommittedOnSuccess(t *testing.T) {
+	iptables := buildIptablesClient(context.Background(), "/proc/1234/ns/net", ipv4, filterTable)
+	// Replace runCommand with a fake that always succeeds without forking a
+	// process or touching nsPath, instead of depending on a real iptables-restore
+	// binary and a real netns switch into a fabricated /proc/1234/ns/net, neither
+	// of which this test can assume exist.
+	iptables.runCommand = func(name string, stdin io.Reader, args ...string) ([]byte, error) {
+		return nil, nil
+	}
+
+	iptables.cache.mu.Lock()
+	iptables.cache.loaded = true
+	iptables.cache.chains = map[string]*iptablesChain{}
+	iptables.cache.mu.Unlock()
+
+	if err := iptables.createNewChain(&iptablesChain{
+		Name:  "CHAOS-TEST",
+		Rules: []string{"-A CHAOS-TEST -j DROP"},
+	}); err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+
+	if err := iptables.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(iptables.priorChains) != 0 {
+		t.Fatalf("expected Flush to clear priorChains, got %d entries", len(iptables.priorChains))
+	}
+	if len(iptables.lastCommitted) == 0 {
+		t.Fatalf("expected Flush to retain the pre-commit snapshot in lastCommitted")
+	}
+
+	// This is the dual-stack BOTH scenario: the v4 side already flushed
+	// successfully, then the v6 side fails and SetContainerIptablesChains calls
+	// Rollback on the v4 client to undo the commit above. Before this fix,
+	// priorChains was already empty at this point and Rollback was a silent
+	// no-op, leaving the v4 commit in place.
+	if err := iptables.Rollback(); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+
+	if got := iptables.cache.chains["CHAOS-TEST"]; got == nil || len(got.Rules) != 0 {
+		t.Fatalf("expected Rollback to restore CHAOS-TEST to its pre-commit (empty) state, got %+v", got)
+	}
+}
+
+func TestRollbackSourcePrefersPriorChainsOverLastCommitted(t *testing.T) {
+	prior := map[string]*iptablesChain{"A": {Name: "A"}}
+	committed := map[string]*iptablesChain{"B": {Name: "B"}}
+
+	if got := rollbackSource(prior, committed); len(got) == 0 {
+		t.Fatalf("rollbackSource returned nothing")
+	} else if _, ok := got["A"]; !ok {
+		t.Fatalf("expected rollbackSource to prefer priorChains, got %v", got)
+	}
+
+	if got := rollbackSource(nil, committed); len(got) == 0 {
+		t.Fatalf("expected rollbackSource to fall back to lastCommitted")
+	} else if _, ok := got["B"]; !ok {
+		t.Fatalf("expected rollbackSource to return lastCommitted, got %v", got)
+	}
+
+	if got := rollbackSource(nil, nil); len(got) != 0 {
+		t.Fatalf("expected rollbackSource(nil, nil) to be empty, got %v", got)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaosd
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNormalizeRule(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"already canonical", "-A CHAOS-INPUT -j DROP", "-A CHAOS-INPUT -j DROP"},
+		{"extra whitespace", "-A   CHAOS-INPUT  -j   DROP", "-A CHAOS-INPUT -j DROP"},
+		{"quoted match-set", `-A CHAOS-INPUT -m set --match-set "my-set" src -j DROP`, "-A CHAOS-INPUT -m set --match-set my-set src -j DROP"},
+		{
+			"wait flag is stripped, as iptables -S never echoes it back",
+			"-A CHAOS-INPUT -m set --match-set my-set src -j DROP -w 5 -p tcp --dport 80",
+			"-A CHAOS-INPUT -m set --match-set my-set src -j DROP -p tcp --dport 80",
+		},
+		{
+			"bare wait flag with no seconds argument is also stripped",
+			"-A CHAOS-INPUT -j DROP -w",
+			"-A CHAOS-INPUT -j DROP",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := normalizeRule(c.in); got != c.want {
+				t.Errorf("normalizeRule(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSplitRuleFields(t *testing.T) {
+	got := splitRuleFields(`-A CHAOS-INPUT -m set --match-set "my set" src -j DROP`)
+	want := []string{"-A", "CHAOS-INPUT", "-m", "set", "--match-set", "my set", "src", "-j", "DROP"}
+
+	if len(got) != len(want) {
+		t.Fatalf("splitRuleFields returned %d fields, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("field %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestStageChainDiffsAgainstCache(t *testing.T) {
+	iptables := buildIptablesClient(context.Background(), "/proc/1234/ns/net", ipv4, filterTable)
+
+	iptables.cache.mu.Lock()
+	iptables.cache.loaded = true
+	iptables.cache.chains = map[string]*iptablesChain{
+		"CHAOS-INPUT": {Name: "CHAOS-INPUT", Rules: []string{"-A CHAOS-INPUT -j DROP"}},
+	}
+	iptables.cache.mu.Unlock()
+
+	if err := iptables.deleteAndWriteRules(&iptablesChain{
+		Name:  "CHAOS-INPUT",
+		Rules: []string{"-A CHAOS-INPUT -j ACCEPT"},
+	}); err != nil {
+		t.Fatalf("deleteAndWriteRules: %v", err)
+	}
+
+	staged, ok := iptables.pendingChains["CHAOS-INPUT"]
+	if !ok {
+		t.Fatalf("expected CHAOS-INPUT to be staged")
+	}
+	if len(staged.Rules) != 1 || staged.Rules[0] != "-A CHAOS-INPUT -j ACCEPT" {
+		t.Fatalf("unexpected staged rules: %v", staged.Rules)
+	}
+
+	prior, ok := iptables.priorChains["CHAOS-INPUT"]
+	if !ok || len(prior.Rules) != 1 || prior.Rules[0] != "-A CHAOS-INPUT -j DROP" {
+		t.Fatalf("expected priorChains to snapshot the old rule, got %+v", prior)
+	}
+}
+
+func TestReleaseIptablesStateRemovesMapEntriesEntirely(t *testing.T) {
+	const nsPath = "/proc/5678/ns/net"
+
+	iptables := buildIptablesClient(context.Background(), nsPath, ipv4, filterTable)
+	cacheKey := iptables.cacheKey()
+	_ = netnsLock(nsPath) // force a lock entry to exist for nsPath
+
+	key := iptablesCacheKey(nsPath, cacheKey)
+	iptablesCachesMu.Lock()
+	_, cached := iptablesCaches[key]
+	iptablesCachesMu.Unlock()
+	if !cached {
+		t.Fatalf("expected buildIptablesClient to have populated the cache map")
+	}
+	if _, ok := netnsLocks.Load(nsPath); !ok {
+		t.Fatalf("expected netnsLock to have populated the lock map")
+	}
+
+	releaseIptablesState(nsPath, cacheKey)
+
+	iptablesCachesMu.Lock()
+	_, cached = iptablesCaches[key]
+	iptablesCachesMu.Unlock()
+	if cached {
+		t.Fatalf("expected releaseIptablesState to delete the cache map entry, not just reset it")
+	}
+	if _, ok := netnsLocks.Load(nsPath); ok {
+		t.Fatalf("expected releaseIptablesState to delete the netns lock entry")
+	}
+}
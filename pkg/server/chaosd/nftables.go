@@ -0,0 +1,191 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaosd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/errors"
+
+	"github.com/chaos-mesh/chaos-daemon/pkg/bpm"
+)
+
+const (
+	nftCmd = "nft"
+
+	nftFamily = "inet"
+	nftTable  = "chaos"
+)
+
+// nftablesClient drives the nftables backend for a single container netns through
+// the `nft` CLI. Unlike iptablesClient it does not need a reconcile cache: every
+// `nft add`/`flush`/`delete` subcommand already commits atomically against the
+// kernel ruleset on its own, so there is nothing to batch.
+type nftablesClient struct {
+	ctx    context.Context
+	nsPath string
+}
+
+func buildNftablesClient(ctx context.Context, nsPath string) *nftablesClient {
+	return &nftablesClient{ctx: ctx, nsPath: nsPath}
+}
+
+func (n *nftablesClient) run(args ...string) error {
+	cmd := bpm.DefaultProcessBuilder(nftCmd, args...).SetNetNS(n.nsPath).SetContext(n.ctx).Build()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return encodeOutputToError(out, err)
+	}
+	return nil
+}
+
+// ensureTable makes sure the dedicated "inet chaos" table and its INPUT/OUTPUT
+// base chains (hooked at the filter priority, same as iptables' builtin chains)
+// exist, so that chaos chains created by EnsureChain have something to be jumped
+// into from.
+func (n *nftablesClient) ensureTable() error {
+	if err := n.run("add", "table", nftFamily, nftTable); err != nil {
+		return err
+	}
+
+	for _, hook := range []string{"input", "output"} {
+		err := n.run("add", "chain", nftFamily, nftTable, hook,
+			"{", "type", "filter", "hook", hook, "priority", "filter", ";", "}")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnsureChain implements FirewallBackend.
+func (n *nftablesClient) EnsureChain(chainName string) error {
+	if err := n.ensureTable(); err != nil {
+		return err
+	}
+
+	// "add chain" is a no-op if the chain already exists, so this alone is
+	// idempotent; existing rules are left untouched until FlushChain is called.
+	return n.run("add", "chain", nftFamily, nftTable, chainName)
+}
+
+// EnsureRule implements FirewallBackend. rule is the same iptables-syntax string
+// applyFirewallChain builds for the iptables backend; it is translated into nft
+// syntax before being compared against (and, if missing, appended to) the chain.
+func (n *nftablesClient) EnsureRule(chainName, rule string) error {
+	nftRule, err := translateIptablesRuleToNft(rule)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	cmd := bpm.DefaultProcessBuilder(nftCmd, "list", "chain", nftFamily, nftTable, chainName).SetNetNS(n.nsPath).SetContext(n.ctx).Build()
+	out, err := cmd.CombinedOutput()
+	if err == nil && strings.Contains(string(out), nftRule) {
+		// The required rule already exists in the chain
+		return nil
+	}
+
+	return n.run("add", "rule", nftFamily, nftTable, chainName, nftRule)
+}
+
+// FlushChain implements FirewallBackend.
+func (n *nftablesClient) FlushChain(chainName string) error {
+	return n.run("flush", "chain", nftFamily, nftTable, chainName)
+}
+
+// DeleteChain implements FirewallBackend.
+func (n *nftablesClient) DeleteChain(chainName string) error {
+	if err := n.run("flush", "chain", nftFamily, nftTable, chainName); err != nil {
+		return err
+	}
+	return n.run("delete", "chain", nftFamily, nftTable, chainName)
+}
+
+// Flush implements FirewallBackend. nft commands are applied as they run, so
+// there is nothing left to commit here.
+func (n *nftablesClient) Flush() error {
+	return nil
+}
+
+// translateIptablesRuleToNft best-effort translates the iptables-style rule
+// strings applyFirewallChain builds (ipset membership match plus a jump target)
+// into nft syntax. It only understands the shapes chaosd itself generates; any
+// protocol/port tail it doesn't recognize is passed through unchanged, since nft
+// accepts most of the same token spellings (e.g. "tcp dport 80").
+func translateIptablesRuleToNft(rule string) (string, error) {
+	fields := splitRuleFields(rule)
+
+	var matchSet, matchDir, target string
+	var tail []string
+
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "-A":
+			i++ // chain name, already applied via `nft ... chainName`
+		case "-m":
+			i++ // "set", implied by --match-set below
+		case "--match-set":
+			if i+2 >= len(fields) {
+				return "", errors.Errorf("malformed --match-set in rule %q", rule)
+			}
+			matchSet = fields[i+1]
+			matchDir = fields[i+2]
+			i += 2
+		case "-j":
+			if i+1 >= len(fields) {
+				return "", errors.Errorf("malformed -j in rule %q", rule)
+			}
+			target = fields[i+1]
+			i++
+		case "-w":
+			i++ // iptables lock wait seconds, meaningless to nft
+		default:
+			tail = append(tail, fields[i])
+		}
+	}
+
+	if target == "" {
+		return "", errors.Errorf("rule %q is not in a shape translateIptablesRuleToNft understands", rule)
+	}
+
+	var parts []string
+
+	if matchSet != "" {
+		addrField := "daddr"
+		if matchDir == "src" {
+			addrField = "saddr"
+		}
+		parts = append(parts, fmt.Sprintf("ip %s @%s", addrField, matchSet))
+	}
+
+	parts = append(parts, tail...)
+	parts = append(parts, nftVerdict(target))
+
+	return strings.Join(parts, " "), nil
+}
+
+// nftVerdict renders an iptables -j target as an nft verdict statement: the
+// handful of built-in terminal actions keep their (lowercased) name, anything
+// else names a regular chain and must be reached with an explicit jump.
+func nftVerdict(target string) string {
+	switch strings.ToUpper(target) {
+	case "ACCEPT", "DROP", "REJECT", "RETURN":
+		return strings.ToLower(target)
+	default:
+		return "jump " + target
+	}
+}
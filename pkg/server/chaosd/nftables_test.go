@@ -0,0 +1,80 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaosd
+
+import "testing"
+
+func TestTranslateIptablesRuleToNft(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			"src match set to a chain jump",
+			"-A CHAOS-INPUT -m set --match-set my-set src -j CHAOS-RULE-0",
+			"ip saddr @my-set jump CHAOS-RULE-0",
+		},
+		{
+			"dst match set to a terminal verdict",
+			"-A CHAOS-INPUT -m set --match-set my-set dst -j DROP",
+			"ip daddr @my-set drop",
+		},
+		{
+			"lock wait flag is dropped",
+			"-A CHAOS-INPUT -m set --match-set my-set src -j ACCEPT -w 5",
+			"ip saddr @my-set accept",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := translateIptablesRuleToNft(c.in)
+			if err != nil {
+				t.Fatalf("translateIptablesRuleToNft(%q): %v", c.in, err)
+			}
+			if got != c.want {
+				t.Errorf("translateIptablesRuleToNft(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTranslateIptablesRuleToNftRejectsUnrecognizedShape(t *testing.T) {
+	if _, err := translateIptablesRuleToNft("-A CHAOS-INPUT -j"); err == nil {
+		t.Errorf("expected an error for a malformed -j")
+	}
+	if _, err := translateIptablesRuleToNft("-A CHAOS-INPUT"); err == nil {
+		t.Errorf("expected an error for a rule with no target")
+	}
+}
+
+func TestNftVerdict(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"ACCEPT", "accept"},
+		{"DROP", "drop"},
+		{"REJECT", "reject"},
+		{"RETURN", "return"},
+		{"CHAOS-RULE-0", "jump CHAOS-RULE-0"},
+	}
+
+	for _, c := range cases {
+		if got := nftVerdict(c.in); got != c.want {
+			t.Errorf("nftVerdict(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}